@@ -0,0 +1,37 @@
+/*
+ * Copyright 2021 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package internal contains functions/structs used by multiple xds resolver
+// packages.
+package internal
+
+var (
+	// NewWRR is used for testing purposes, to mock out the wrr.NewRandom
+	// function used by the xds resolver.
+	NewWRR interface{} // func() wrr.WRR
+
+	// NewXDSClient is used for testing purposes, to mock out the
+	// xdsclient.New function used by the xds resolver to create a client
+	// talking to the full set of servers in the bootstrap configuration.
+	NewXDSClient interface{} // func() (xdsclient.XDSClient, func(), error)
+
+	// NewXDSClientForServerConfig is used for testing purposes, to mock out
+	// the xdsclient.NewWithServerConfig function used by the xds resolver
+	// to create a client talking to a single xDS server, for use with the
+	// gRFC A71/A74 fallback servers in a target's xds_servers chain.
+	NewXDSClientForServerConfig interface{} // func(*bootstrap.ServerConfig) (xdsclient.XDSClient, func(), error)
+)
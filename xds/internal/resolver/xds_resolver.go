@@ -24,8 +24,10 @@ import (
 	"fmt"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"google.golang.org/grpc/credentials"
+	estats "google.golang.org/grpc/experimental/stats"
 	"google.golang.org/grpc/internal"
 	"google.golang.org/grpc/internal/grpclog"
 	"google.golang.org/grpc/internal/grpcrand"
@@ -46,6 +48,64 @@ import (
 // xdsresolver.Scheme
 const Scheme = "xds"
 
+// fallbackTimeout is the grace period the resolver gives a newly-watched
+// xDS server, per gRFC A71, to deliver the Listener and RouteConfiguration
+// resources before falling back to the next server in the xds_servers
+// fallback chain. This includes a higher-priority server that the resolver
+// has just reverted to, which is fallen back away from again if it does not
+// deliver them in time. It is a variable so that tests can override it.
+var fallbackTimeout = 10 * time.Second
+
+// recoveryCheckInterval controls how often the resolver re-attempts a
+// higher-priority xDS server (eventually the primary) while it is relying
+// on a fallback server. It is a variable so that tests can override it.
+var recoveryCheckInterval = 1 * time.Minute
+
+// xdsServerConfigsForTarget returns the ordered fallback chain of xDS
+// server configs to use for target: the per-authority xds_servers list if
+// the target specifies an authority and that authority configures one, and
+// the top-level bootstrap xds_servers list otherwise. Index 0 of the
+// returned slice is the primary server.
+func xdsServerConfigsForTarget(target resolver.Target, bootstrapConfig *bootstrap.Config) []*bootstrap.ServerConfig {
+	if authority := target.URL.Host; authority != "" {
+		if a := bootstrapConfig.Authorities[authority]; a != nil && len(a.XDSServers) > 0 {
+			return a.XDSServers
+		}
+	}
+	return bootstrapConfig.XDSServers
+}
+
+// serverFeatureIgnoreResourceDeletion is the bootstrap server feature that
+// opts a management server into the xDS "ignore_resource_deletion"
+// semantics: the resolver keeps serving the last-known-good Listener and
+// RouteConfiguration, instead of failing RPCs, when that server deletes
+// the corresponding resource.
+const serverFeatureIgnoreResourceDeletion = "ignore_resource_deletion"
+
+// serverSupportsIgnoreResourceDeletion reports whether sc advertises the
+// ignore_resource_deletion server feature.
+func serverSupportsIgnoreResourceDeletion(sc *bootstrap.ServerConfig) bool {
+	for _, f := range sc.ServerFeatures {
+		if f == serverFeatureIgnoreResourceDeletion {
+			return true
+		}
+	}
+	return false
+}
+
+// staleConfigDeletionsIgnoredMetric counts, per target, how many times the
+// xDS resolver ignored a Listener or RouteConfiguration deletion because
+// the serving management server advertises the ignore_resource_deletion
+// feature, so that operators can observe how often RPCs are being routed
+// with a stale configuration without having to scrape logs.
+var staleConfigDeletionsIgnoredMetric = estats.RegisterInt64Count(estats.MetricDescriptor{
+	Name:        "grpc.xds_resolver.resource_deletions_ignored",
+	Description: "Number of times the xDS resolver ignored a Listener or RouteConfiguration deletion because the management server advertises the ignore_resource_deletion feature, continuing to serve the last-known-good configuration instead.",
+	Unit:        "deletion",
+	Labels:      []string{"grpc.target"},
+	Default:     false,
+})
+
 // newBuilderForTesting creates a new xds resolver builder using a specific xds
 // bootstrap config, so tests can use multiple xds clients in different
 // ClientConns at the same time.
@@ -63,6 +123,7 @@ func init() {
 
 	rinternal.NewWRR = wrr.NewRandom
 	rinternal.NewXDSClient = xdsclient.New
+	rinternal.NewXDSClientForServerConfig = xdsclient.NewWithServerConfig
 }
 
 type xdsResolverBuilder struct {
@@ -75,9 +136,11 @@ type xdsResolverBuilder struct {
 // time an xds resolver is built.
 func (b *xdsResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (_ resolver.Resolver, retErr error) {
 	r := &xdsResolver{
-		cc:             cc,
-		activeClusters: make(map[string]*clusterInfo),
-		channelID:      grpcrand.Uint64(),
+		cc:              cc,
+		target:          target.String(),
+		metricsRecorder: opts.MetricsRecorder,
+		activeClusters:  make(map[string]*clusterInfo),
+		channelID:       grpcrand.Uint64(),
 	}
 	defer func() {
 		if retErr != nil {
@@ -108,10 +171,10 @@ func (b *xdsResolverBuilder) Build(target resolver.Target, cc resolver.ClientCon
 		return nil, fmt.Errorf("xds: failed to create xds-client: %v", err)
 	}
 	r.xdsClient = client
-	r.xdsClientClose = close
+	r.xdsClientCloses = append(r.xdsClientCloses, close)
 
 	// Determine the listener resource name and start a watcher for it.
-	template, err := r.sanityChecksOnBootstrapConfig(target, opts, r.xdsClient)
+	template, servers, err := r.sanityChecksOnBootstrapConfig(target, opts, r.xdsClient)
 	if err != nil {
 		return nil, err
 	}
@@ -121,6 +184,21 @@ func (b *xdsResolverBuilder) Build(target resolver.Target, cc resolver.ClientCon
 	}
 	endpoint = strings.TrimPrefix(endpoint, "/")
 	r.ldsResourceName = bootstrap.PopulateResourceTemplate(template, endpoint)
+
+	// Record the ordered fallback chain of xDS servers for this target, per
+	// gRFC A71/A74. serverClients is indexed identically to xdsServers, and
+	// is populated lazily as the resolver falls back to (or recovers to)
+	// each server; the primary (index 0) is already connected above.
+	r.xdsServers = servers
+	r.serverClients = make([]xdsclient.XDSClient, len(servers))
+	if len(servers) > 0 {
+		r.serverClients[0] = r.xdsClient
+		r.ignoreResourceDeletion = serverSupportsIgnoreResourceDeletion(servers[0])
+	}
+
+	// Arm the fallback timer before starting the watch, so that no watch
+	// callback can run concurrently with it or complete resolution before it.
+	r.startFallbackTimer()
 	r.listenerWatcher = newListenerWatcher(r.ldsResourceName, r)
 	return r, nil
 }
@@ -132,14 +210,16 @@ func (b *xdsResolverBuilder) Build(target resolver.Target, cc resolver.ClientCon
 //   - Verifies that if the provided dial target contains an authority, the
 //     bootstrap configuration contains server config for that authority.
 //
-// Returns the listener resource name template to use. If any of the above
-// validations fail, a non-nil error is returned.
-func (r *xdsResolver) sanityChecksOnBootstrapConfig(target resolver.Target, opts resolver.BuildOptions, client xdsclient.XDSClient) (string, error) {
+// Returns the listener resource name template to use, along with the
+// ordered fallback chain of xDS server configs for target (see
+// xdsServerConfigsForTarget). If any of the above validations fail, a
+// non-nil error is returned.
+func (r *xdsResolver) sanityChecksOnBootstrapConfig(target resolver.Target, opts resolver.BuildOptions, client xdsclient.XDSClient) (string, []*bootstrap.ServerConfig, error) {
 	bootstrapConfig := client.BootstrapConfig()
 	if bootstrapConfig == nil {
 		// This is never expected to happen after a successful xDS client
 		// creation. Defensive programming.
-		return "", fmt.Errorf("xds: bootstrap configuration is empty")
+		return "", nil, fmt.Errorf("xds: bootstrap configuration is empty")
 	}
 
 	// If xDS credentials were specified by the user, but the bootstrap config
@@ -155,7 +235,7 @@ func (r *xdsResolver) sanityChecksOnBootstrapConfig(target resolver.Target, opts
 	}
 	if xc, ok := creds.(interface{ UsesXDS() bool }); ok && xc.UsesXDS() {
 		if len(bootstrapConfig.CertProviderConfigs) == 0 {
-			return "", fmt.Errorf("xds: use of xDS credentials is specified, but certificate_providers config missing in bootstrap file")
+			return "", nil, fmt.Errorf("xds: use of xDS credentials is specified, but certificate_providers config missing in bootstrap file")
 		}
 	}
 
@@ -166,7 +246,7 @@ func (r *xdsResolver) sanityChecksOnBootstrapConfig(target resolver.Target, opts
 	if authority := target.URL.Host; authority != "" {
 		a := bootstrapConfig.Authorities[authority]
 		if a == nil {
-			return "", fmt.Errorf("xds: authority %q specified in dial target %q is not found in the bootstrap file", authority, target)
+			return "", nil, fmt.Errorf("xds: authority %q specified in dial target %q is not found in the bootstrap file", authority, target)
 		}
 		if a.ClientListenerResourceNameTemplate != "" {
 			// This check will never be false, because
@@ -175,7 +255,7 @@ func (r *xdsResolver) sanityChecksOnBootstrapConfig(target resolver.Target, opts
 			template = a.ClientListenerResourceNameTemplate
 		}
 	}
-	return template, nil
+	return template, xdsServerConfigsForTarget(target, bootstrapConfig), nil
 }
 
 // Name helps implement the resolver.Builder interface.
@@ -191,13 +271,56 @@ func (*xdsResolverBuilder) Scheme() string {
 type xdsResolver struct {
 	cc     resolver.ClientConn
 	logger *grpclog.PrefixLogger
-	// The underlying xdsClient which performs all xDS requests and responses.
-	xdsClient      xdsclient.XDSClient
-	xdsClientClose func()
+	// target is the string form of the resolver.Target this resolver was
+	// built for, used as the "grpc.target" label when recording metrics.
+	target string
+	// metricsRecorder records metrics for this resolver, e.g. the number of
+	// stale-config servings caused by ignoreResourceDeletion. It is taken
+	// from resolver.BuildOptions and may be a no-op recorder.
+	metricsRecorder estats.MetricsRecorder
+	// xdsClient is the xdsClient which performs all xDS requests and
+	// responses for the server currently in use (xdsServers[serverIndex]).
+	// It changes over the lifetime of the resolver as the resolver falls
+	// back to, or recovers from, the servers in xdsServers.
+	xdsClient xdsclient.XDSClient
+	// xdsClientCloses holds the close function of every xdsClient created
+	// by this resolver over its lifetime (the primary, plus any fallback
+	// servers connected to along the way), all of which are invoked on
+	// Close.
+	xdsClientCloses []func()
 	// A random number which uniquely identifies the channel which owns this
 	// resolver.
 	channelID uint64
 
+	// xdsServers is the ordered fallback chain of xDS server configs for
+	// this target, as found in the bootstrap file's xds_servers list (see
+	// xdsServerConfigsForTarget); xdsServers[0] is the primary. serverIndex
+	// is the index, into xdsServers, of the server that xdsClient currently
+	// talks to, and serverClients caches the xdsclient.XDSClient created
+	// for each server visited so far, indexed identically to xdsServers.
+	// See gRFC A71.
+	xdsServers    []*bootstrap.ServerConfig
+	serverIndex   int
+	serverClients []xdsclient.XDSClient
+	// fallbackTimer, when non-nil, fires fallbackTimeout after a watch was
+	// (re)started on the server at serverIndex without a resource update
+	// having been received, and triggers a move to the next entry in
+	// xdsServers.
+	fallbackTimer *time.Timer
+	// recoveryTimer, when non-nil, fires recoveryCheckInterval after
+	// falling back away from the primary, and triggers an attempt to
+	// revert to the next-higher-priority server in xdsServers.
+	recoveryTimer *time.Timer
+	// ignoreResourceDeletion records whether xdsServers[serverIndex]
+	// advertises the "ignore_resource_deletion" server feature. It is
+	// recomputed every time the active server changes.
+	ignoreResourceDeletion bool
+	// numResourcesServedStale counts how many times a Listener or
+	// RouteConfiguration deletion was ignored because of
+	// ignoreResourceDeletion, so that operators can observe how often RPCs
+	// are being served with a stale configuration.
+	numResourcesServedStale uint64
+
 	// All methods on the xdsResolver type except for the ones invoked by gRPC,
 	// i.e ResolveNow() and Close(), are guaranteed to execute in the context of
 	// this serializer's callback. And since the serializer guarantees mutual
@@ -240,14 +363,16 @@ func (r *xdsResolver) Close() {
 	// set in the constructor. This is because the constructor defers Close() in
 	// error cases, and the fields might not be set when the error happens.
 
+	r.stopFallbackTimer()
+	r.stopRecoveryTimer()
 	if r.listenerWatcher != nil {
 		r.listenerWatcher.stop()
 	}
 	if r.routeConfigWatcher != nil {
 		r.routeConfigWatcher.stop()
 	}
-	if r.xdsClientClose != nil {
-		r.xdsClientClose()
+	for _, close := range r.xdsClientCloses {
+		close()
 	}
 	r.logger.Infof("Shutdown")
 }
@@ -428,6 +553,13 @@ func (r *xdsResolver) onResolutionComplete() {
 
 	r.curConfigSelector.stop()
 	r.curConfigSelector = cs
+
+	// We have a usable config from the server currently in use; there is no
+	// need to fall back away from it, and if we are already on a fallback
+	// server, it's time to start trying to move back to a higher-priority
+	// one.
+	r.stopFallbackTimer()
+	r.maybeStartRecoveryTimer()
 }
 
 func (r *xdsResolver) applyRouteConfigUpdate(update xdsresource.RouteConfigUpdate) {
@@ -457,6 +589,17 @@ func (r *xdsResolver) onError(err error) {
 //
 // Only executed in the context of a serializer callback.
 func (r *xdsResolver) onResourceNotFound() {
+	if r.serverIndex < len(r.xdsServers)-1 {
+		// A lower-priority xDS server is configured as a fallback for this
+		// target. Keep routing RPCs with the last-known-good config selector
+		// rather than collapsing live traffic, and (re)arm fallbackTimer for
+		// a full fallbackTimeout; if it expires before a valid update
+		// arrives, fallbackToNextServer will take over.
+		r.logger.Warningf("Resource not found on xDS server %q; waiting up to %v before falling back to %q", r.xdsServers[r.serverIndex].ServerURI, fallbackTimeout, r.xdsServers[r.serverIndex+1].ServerURI)
+		r.startFallbackTimer()
+		return
+	}
+
 	// We cannot remove clusters from the service config that have ongoing RPCs.
 	// Instead, what we can do is to send an erroring (nil) config selector
 	// along with normal service config. This will ensure that new RPCs will
@@ -530,6 +673,18 @@ func (r *xdsResolver) onListenerResourceNotFound() {
 		r.logger.Infof("Received resource-not-found-error for Listener resource %q", r.ldsResourceName)
 	}
 
+	if r.ignoreResourceDeletion {
+		r.numResourcesServedStale++
+		staleConfigDeletionsIgnoredMetric.Record(r.metricsRecorder, 1, r.target)
+		r.logger.Warningf("Listener resource %q was deleted by xDS server %q; server advertises the ignore_resource_deletion feature, so RPCs will continue to be routed using the last-known-good configuration (stale configs served so far: %d)", r.ldsResourceName, r.xdsServers[r.serverIndex].ServerURI, r.numResourcesServedStale)
+		// This server is still alive and reachable; it intentionally asked
+		// us to keep the last-known-good configuration rather than fail
+		// RPCs, which is the opposite of a reason to fall back away from
+		// it.
+		r.stopFallbackTimer()
+		return
+	}
+
 	r.listenerUpdateRecvd = false
 
 	if r.routeConfigWatcher != nil {
@@ -574,6 +729,15 @@ func (r *xdsResolver) onRouteConfigResourceNotFound(name string) {
 	if r.rdsResourceName != name {
 		return
 	}
+
+	if r.ignoreResourceDeletion {
+		r.numResourcesServedStale++
+		staleConfigDeletionsIgnoredMetric.Record(r.metricsRecorder, 1, r.target)
+		r.logger.Warningf("RouteConfiguration resource %q was deleted by xDS server %q; server advertises the ignore_resource_deletion feature, so RPCs will continue to be routed using the last-known-good configuration (stale configs served so far: %d)", name, r.xdsServers[r.serverIndex].ServerURI, r.numResourcesServedStale)
+		r.stopFallbackTimer()
+		return
+	}
+
 	r.onResourceNotFound()
 }
 
@@ -581,3 +745,165 @@ func (r *xdsResolver) onRouteConfigResourceNotFound(name string) {
 func (r *xdsResolver) onClusterRefDownToZero() {
 	r.sendNewServiceConfig(r.curConfigSelector)
 }
+
+// startFallbackTimer arms (or re-arms) fallbackTimer to fire fallbackTimeout
+// from now, unless the server currently in use is already the last one in
+// xdsServers, in which case there is nothing left to fall back to and any
+// pending timer is cancelled instead.
+//
+// Only executed in the context of a serializer callback.
+func (r *xdsResolver) startFallbackTimer() {
+	if r.serverIndex >= len(r.xdsServers)-1 {
+		r.stopFallbackTimer()
+		return
+	}
+	if r.fallbackTimer != nil {
+		r.fallbackTimer.Stop()
+	}
+	r.fallbackTimer = time.AfterFunc(fallbackTimeout, func() {
+		r.serializer.Schedule(func(context.Context) { r.fallbackToNextServer() })
+	})
+}
+
+// stopFallbackTimer cancels a pending fallback. It is called once a usable
+// resource update has been received from the server currently in use.
+//
+// Only executed in the context of a serializer callback.
+func (r *xdsResolver) stopFallbackTimer() {
+	if r.fallbackTimer != nil {
+		r.fallbackTimer.Stop()
+		r.fallbackTimer = nil
+	}
+}
+
+// maybeStartRecoveryTimer arms recoveryTimer, if not already armed, when the
+// resolver is currently relying on a fallback server rather than the
+// primary. It is a no-op when already on the primary (serverIndex 0).
+//
+// Only executed in the context of a serializer callback.
+func (r *xdsResolver) maybeStartRecoveryTimer() {
+	if r.serverIndex == 0 || r.recoveryTimer != nil {
+		return
+	}
+	r.recoveryTimer = time.AfterFunc(recoveryCheckInterval, func() {
+		r.serializer.Schedule(func(context.Context) {
+			r.recoveryTimer = nil
+			r.tryRevertToHigherPriorityServer()
+		})
+	})
+}
+
+// stopRecoveryTimer cancels a pending recovery attempt.
+//
+// Only executed in the context of a serializer callback.
+func (r *xdsResolver) stopRecoveryTimer() {
+	if r.recoveryTimer != nil {
+		r.recoveryTimer.Stop()
+		r.recoveryTimer = nil
+	}
+}
+
+// clientForServer returns the xdsclient.XDSClient for r.xdsServers[idx],
+// creating and caching one via rinternal.NewXDSClientForServerConfig the
+// first time the resolver talks to that server.
+//
+// Only executed in the context of a serializer callback.
+func (r *xdsResolver) clientForServer(idx int) (xdsclient.XDSClient, error) {
+	if c := r.serverClients[idx]; c != nil {
+		return c, nil
+	}
+	newXDSClientForServerConfig := rinternal.NewXDSClientForServerConfig.(func(*bootstrap.ServerConfig) (xdsclient.XDSClient, func(), error))
+	client, close, err := newXDSClientForServerConfig(r.xdsServers[idx])
+	if err != nil {
+		return nil, err
+	}
+	r.serverClients[idx] = client
+	r.xdsClientCloses = append(r.xdsClientCloses, close)
+	return client, nil
+}
+
+// switchWatchersToClient moves the listenerWatcher and routeConfigWatcher
+// (if any) over to client, re-subscribing to the same resource names, and
+// makes client the active r.xdsClient. The ClientConn and its addresses,
+// as well as the last-known-good r.currentListener/r.currentVirtualHost,
+// are left untouched, so RPCs keep flowing with the last-known-good config
+// selector while fresh updates are awaited from client.
+//
+// Only executed in the context of a serializer callback.
+func (r *xdsResolver) switchWatchersToClient(client xdsclient.XDSClient) {
+	r.xdsClient = client
+	r.ignoreResourceDeletion = serverSupportsIgnoreResourceDeletion(r.xdsServers[r.serverIndex])
+
+	r.listenerWatcher.stop()
+	r.listenerUpdateRecvd = false
+	r.listenerWatcher = newListenerWatcher(r.ldsResourceName, r)
+
+	if r.routeConfigWatcher != nil {
+		r.routeConfigWatcher.stop()
+		r.routeConfigUpdateRecvd = false
+		r.routeConfigWatcher = newRouteConfigWatcher(r.rdsResourceName, r)
+	}
+}
+
+// fallbackToNextServer switches the resolver from the server currently in
+// use to the next one in xdsServers, without tearing down the ClientConn,
+// per gRFC A71. It is invoked when fallbackTimer fires, i.e. the server
+// currently in use has failed to deliver a usable Listener or
+// RouteConfiguration resource within fallbackTimeout of the watch being
+// (re)started.
+//
+// Only executed in the context of a serializer callback.
+func (r *xdsResolver) fallbackToNextServer() {
+	if r.serverIndex >= len(r.xdsServers)-1 {
+		// Nothing left to fall back to.
+		return
+	}
+	next := r.serverIndex + 1
+	r.logger.Warningf("Falling back to xDS server %q (server %d of %d)", r.xdsServers[next].ServerURI, next+1, len(r.xdsServers))
+
+	// A pending recovery attempt was premised on the server we are about to
+	// leave being healthy; it no longer is, so cancel it. onResolutionComplete
+	// will re-arm it once the new server proves itself.
+	r.stopRecoveryTimer()
+
+	client, err := r.clientForServer(next)
+	if err != nil {
+		r.onError(fmt.Errorf("xds: failed to create xds-client for fallback server %q, will retry in %v: %v", r.xdsServers[next].ServerURI, fallbackTimeout, err))
+		// Stay on the current server and retry the fallback after another
+		// grace period, rather than getting permanently stuck here.
+		r.startFallbackTimer()
+		return
+	}
+	r.serverIndex = next
+	r.switchWatchersToClient(client)
+	r.startFallbackTimer()
+}
+
+// tryRevertToHigherPriorityServer attempts to move the resolver's watchers
+// back from the server currently in use to the one immediately preceding
+// it in xdsServers (eventually reaching the primary, at index 0), as
+// recommended by gRFC A71 once a higher-priority server may have
+// recovered. If that server is still unhealthy, fallbackTimer fires again
+// within fallbackTimeout and fallbackToNextServer drives the resolver back
+// to the server used here.
+//
+// Only executed in the context of a serializer callback.
+func (r *xdsResolver) tryRevertToHigherPriorityServer() {
+	if r.serverIndex == 0 {
+		return
+	}
+	target := r.serverIndex - 1
+	r.logger.Infof("Attempting to revert from xDS server %q back to higher-priority server %q", r.xdsServers[r.serverIndex].ServerURI, r.xdsServers[target].ServerURI)
+
+	client, err := r.clientForServer(target)
+	if err != nil {
+		r.onError(fmt.Errorf("xds: failed to create xds-client for xds server %q, will retry in %v: %v", r.xdsServers[target].ServerURI, recoveryCheckInterval, err))
+		// Leave serverIndex unchanged and try again later instead of
+		// abandoning recovery permanently.
+		r.maybeStartRecoveryTimer()
+		return
+	}
+	r.serverIndex = target
+	r.switchWatchersToClient(client)
+	r.startFallbackTimer()
+}
@@ -0,0 +1,331 @@
+/*
+ * Copyright 2024 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+
+	estats "google.golang.org/grpc/experimental/stats"
+	"google.golang.org/grpc/internal/grpcsync"
+	"google.golang.org/grpc/resolver"
+	rinternal "google.golang.org/grpc/xds/internal/resolver/internal"
+	"google.golang.org/grpc/xds/internal/xdsclient"
+	"google.golang.org/grpc/xds/internal/xdsclient/bootstrap"
+)
+
+// newTestResolverForFallback returns an xdsResolver with just enough state
+// initialized to exercise the fallback/recovery state machine in isolation,
+// without a real xdsClient or watchers.
+func newTestResolverForFallback(t *testing.T, servers []*bootstrap.ServerConfig) *xdsResolver {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &xdsResolver{
+		cc:              &testClientConn{},
+		target:          "xds:///test",
+		metricsRecorder: noopMetricsRecorder{},
+		xdsServers:      servers,
+		serverClients:   make([]xdsclient.XDSClient, len(servers)),
+	}
+	r.serializer = grpcsync.NewCallbackSerializer(ctx)
+	r.serializerCancel = cancel
+	r.logger = prefixLogger(r)
+	return r
+}
+
+func TestXDSServerConfigsForTarget(t *testing.T) {
+	primary := &bootstrap.ServerConfig{ServerURI: "primary"}
+	fallback := &bootstrap.ServerConfig{ServerURI: "fallback"}
+	authorityPrimary := &bootstrap.ServerConfig{ServerURI: "authority-primary"}
+
+	tests := []struct {
+		name   string
+		target resolver.Target
+		config *bootstrap.Config
+		want   []*bootstrap.ServerConfig
+	}{
+		{
+			name:   "no authority uses top-level servers",
+			target: resolver.Target{URL: *mustParseURL(t, "xds:///foo")},
+			config: &bootstrap.Config{XDSServers: []*bootstrap.ServerConfig{primary, fallback}},
+			want:   []*bootstrap.ServerConfig{primary, fallback},
+		},
+		{
+			name:   "authority with its own servers overrides top-level",
+			target: resolver.Target{URL: *mustParseURL(t, "xds://auth/foo")},
+			config: &bootstrap.Config{
+				XDSServers: []*bootstrap.ServerConfig{primary, fallback},
+				Authorities: map[string]*bootstrap.Authority{
+					"auth": {XDSServers: []*bootstrap.ServerConfig{authorityPrimary}},
+				},
+			},
+			want: []*bootstrap.ServerConfig{authorityPrimary},
+		},
+		{
+			name:   "authority without its own servers falls back to top-level",
+			target: resolver.Target{URL: *mustParseURL(t, "xds://auth/foo")},
+			config: &bootstrap.Config{
+				XDSServers:  []*bootstrap.ServerConfig{primary, fallback},
+				Authorities: map[string]*bootstrap.Authority{"auth": {}},
+			},
+			want: []*bootstrap.ServerConfig{primary, fallback},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := xdsServerConfigsForTarget(test.target, test.config)
+			if len(got) != len(test.want) {
+				t.Fatalf("xdsServerConfigsForTarget() = %v, want %v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("xdsServerConfigsForTarget()[%d] = %v, want %v", i, got[i], test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestStartFallbackTimer_LastServerDoesNotArm(t *testing.T) {
+	servers := []*bootstrap.ServerConfig{{ServerURI: "primary"}, {ServerURI: "secondary"}}
+	r := newTestResolverForFallback(t, servers)
+	defer r.Close()
+
+	r.serverIndex = 1 // already on the last server in the chain
+	r.startFallbackTimer()
+	if r.fallbackTimer != nil {
+		t.Fatalf("fallbackTimer = %v, want nil when already on the last server", r.fallbackTimer)
+	}
+
+	r.serverIndex = 0 // a fallback server is still available
+	r.startFallbackTimer()
+	if r.fallbackTimer == nil {
+		t.Fatalf("fallbackTimer = nil, want armed when a fallback server is available")
+	}
+}
+
+func TestStopFallbackTimer_Idempotent(t *testing.T) {
+	servers := []*bootstrap.ServerConfig{{ServerURI: "primary"}, {ServerURI: "secondary"}}
+	r := newTestResolverForFallback(t, servers)
+	defer r.Close()
+
+	r.startFallbackTimer()
+	r.stopFallbackTimer()
+	if r.fallbackTimer != nil {
+		t.Fatalf("fallbackTimer = %v, want nil after stopFallbackTimer", r.fallbackTimer)
+	}
+	// Calling it again on an already-stopped timer must not panic.
+	r.stopFallbackTimer()
+}
+
+func TestMaybeStartRecoveryTimer(t *testing.T) {
+	servers := []*bootstrap.ServerConfig{{ServerURI: "primary"}, {ServerURI: "secondary"}}
+	r := newTestResolverForFallback(t, servers)
+	defer r.Close()
+
+	r.serverIndex = 0
+	r.maybeStartRecoveryTimer()
+	if r.recoveryTimer != nil {
+		t.Fatalf("recoveryTimer = %v, want nil while on the primary", r.recoveryTimer)
+	}
+
+	r.serverIndex = 1
+	r.maybeStartRecoveryTimer()
+	if r.recoveryTimer == nil {
+		t.Fatalf("recoveryTimer = nil, want armed while on a fallback server")
+	}
+	armed := r.recoveryTimer
+	r.maybeStartRecoveryTimer()
+	if r.recoveryTimer != armed {
+		t.Fatalf("maybeStartRecoveryTimer re-armed an already-pending timer")
+	}
+
+	r.stopRecoveryTimer()
+	if r.recoveryTimer != nil {
+		t.Fatalf("recoveryTimer = %v, want nil after stopRecoveryTimer", r.recoveryTimer)
+	}
+}
+
+func TestClose_StopsPendingTimers(t *testing.T) {
+	servers := []*bootstrap.ServerConfig{{ServerURI: "primary"}, {ServerURI: "secondary"}}
+	r := newTestResolverForFallback(t, servers)
+
+	r.serverIndex = 1
+	r.startFallbackTimer()
+	r.maybeStartRecoveryTimer()
+
+	// Close must not panic with timers pending, and must leave them
+	// cancelled so they cannot fire after the resolver is gone.
+	r.Close()
+	if r.fallbackTimer != nil || r.recoveryTimer != nil {
+		t.Fatalf("Close() left fallbackTimer=%v recoveryTimer=%v, want both nil", r.fallbackTimer, r.recoveryTimer)
+	}
+}
+
+// fakeXDSClient is a minimal xdsclient.XDSClient stand-in for tests that
+// only need client identity (e.g. to verify it gets cached or made
+// active), not any real xDS behavior. It embeds the interface so that it
+// satisfies xdsclient.XDSClient without implementing every method.
+type fakeXDSClient struct {
+	xdsclient.XDSClient
+}
+
+// TestClientForServer_CachesSuccessfulClient covers the success path of
+// clientForServer: the client returned by rinternal.NewXDSClientForServerConfig
+// is cached in serverClients (so that a later fallback/revert to the same
+// server reuses it instead of creating a new one) and its close function is
+// recorded so Close() will eventually release it. This is the mechanism
+// fallbackToNextServer/tryRevertToHigherPriorityServer rely on to advance
+// serverIndex and hand a new client to switchWatchersToClient on success;
+// only the client-creation-failure path was previously covered.
+func TestClientForServer_CachesSuccessfulClient(t *testing.T) {
+	servers := []*bootstrap.ServerConfig{{ServerURI: "primary"}, {ServerURI: "secondary"}}
+	r := newTestResolverForFallback(t, servers)
+	defer r.Close()
+
+	wantClient := &fakeXDSClient{}
+	restore := rinternal.NewXDSClientForServerConfig
+	defer func() { rinternal.NewXDSClientForServerConfig = restore }()
+	rinternal.NewXDSClientForServerConfig = func(sc *bootstrap.ServerConfig) (xdsclient.XDSClient, func(), error) {
+		if sc != servers[1] {
+			t.Fatalf("NewXDSClientForServerConfig called with %v, want %v", sc, servers[1])
+		}
+		return wantClient, func() {}, nil
+	}
+
+	got, err := r.clientForServer(1)
+	if err != nil {
+		t.Fatalf("clientForServer(1) failed: %v", err)
+	}
+	if got != wantClient {
+		t.Fatalf("clientForServer(1) = %v, want %v", got, wantClient)
+	}
+	if r.serverClients[1] != wantClient {
+		t.Fatalf("serverClients[1] = %v, want %v to be cached", r.serverClients[1], wantClient)
+	}
+	if len(r.xdsClientCloses) != 1 {
+		t.Fatalf("xdsClientCloses has %d entries, want 1", len(r.xdsClientCloses))
+	}
+
+	// A second call for the same index must reuse the cached client rather
+	// than creating (and needing to close) another one.
+	rinternal.NewXDSClientForServerConfig = func(*bootstrap.ServerConfig) (xdsclient.XDSClient, func(), error) {
+		t.Fatalf("NewXDSClientForServerConfig called again for an already-cached server index")
+		return nil, nil, nil
+	}
+	got2, err := r.clientForServer(1)
+	if err != nil {
+		t.Fatalf("clientForServer(1) (cached) failed: %v", err)
+	}
+	if got2 != wantClient {
+		t.Fatalf("clientForServer(1) (cached) = %v, want %v", got2, wantClient)
+	}
+	if len(r.xdsClientCloses) != 1 {
+		t.Fatalf("xdsClientCloses has %d entries after a cached lookup, want still 1", len(r.xdsClientCloses))
+	}
+}
+
+// Note: the remaining step of a successful fallback/revert —
+// switchWatchersToClient re-subscribing the Listener and RouteConfiguration
+// watchers against the newly-selected client — is not exercised by the
+// tests in this file.
+
+func TestFallbackToNextServer_ClientCreationFailureRetries(t *testing.T) {
+	servers := []*bootstrap.ServerConfig{{ServerURI: "primary"}, {ServerURI: "secondary"}}
+	r := newTestResolverForFallback(t, servers)
+	defer r.Close()
+
+	restore := rinternal.NewXDSClientForServerConfig
+	defer func() { rinternal.NewXDSClientForServerConfig = restore }()
+	wantErr := errors.New("dial failure")
+	rinternal.NewXDSClientForServerConfig = func(*bootstrap.ServerConfig) (xdsclient.XDSClient, func(), error) {
+		return nil, nil, wantErr
+	}
+
+	cc := r.cc.(*testClientConn)
+	r.fallbackToNextServer()
+
+	if r.serverIndex != 0 {
+		t.Fatalf("serverIndex = %d, want 0 (unchanged after a failed fallback attempt)", r.serverIndex)
+	}
+	if r.fallbackTimer == nil {
+		t.Fatalf("fallbackTimer = nil, want a retry to be scheduled after a failed fallback attempt")
+	}
+	if len(cc.errs) != 1 {
+		t.Fatalf("ReportError called %d times, want 1", len(cc.errs))
+	}
+}
+
+func TestTryRevertToHigherPriorityServer_ClientCreationFailureRetries(t *testing.T) {
+	servers := []*bootstrap.ServerConfig{{ServerURI: "primary"}, {ServerURI: "secondary"}}
+	r := newTestResolverForFallback(t, servers)
+	defer r.Close()
+	r.serverIndex = 1 // currently relying on the fallback server
+
+	restore := rinternal.NewXDSClientForServerConfig
+	defer func() { rinternal.NewXDSClientForServerConfig = restore }()
+	wantErr := errors.New("dial failure")
+	rinternal.NewXDSClientForServerConfig = func(*bootstrap.ServerConfig) (xdsclient.XDSClient, func(), error) {
+		return nil, nil, wantErr
+	}
+
+	cc := r.cc.(*testClientConn)
+	r.tryRevertToHigherPriorityServer()
+
+	if r.serverIndex != 1 {
+		t.Fatalf("serverIndex = %d, want 1 (unchanged after a failed revert attempt)", r.serverIndex)
+	}
+	if r.recoveryTimer == nil {
+		t.Fatalf("recoveryTimer = nil, want another revert attempt to be scheduled")
+	}
+	if len(cc.errs) != 1 {
+		t.Fatalf("ReportError called %d times, want 1", len(cc.errs))
+	}
+}
+
+// testClientConn is a minimal resolver.ClientConn that records the errors
+// reported to it.
+type testClientConn struct {
+	resolver.ClientConn
+	errs []error
+}
+
+func (t *testClientConn) ReportError(err error) {
+	t.errs = append(t.errs, err)
+}
+
+func (t *testClientConn) UpdateState(resolver.State) error { return nil }
+
+// noopMetricsRecorder is a minimal estats.MetricsRecorder that discards the
+// int64 counts recorded on it, the only kind of metric the resolver records.
+type noopMetricsRecorder struct {
+	estats.MetricsRecorder
+}
+
+func (noopMetricsRecorder) RecordInt64Count(*estats.Int64CountHandle, int64, ...string) {}
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("url.Parse(%q) failed: %v", raw, err)
+	}
+	return u
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright 2024 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package resolver
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/xds/internal/xdsclient/bootstrap"
+	"google.golang.org/grpc/xds/internal/xdsclient/xdsresource"
+)
+
+func TestServerSupportsIgnoreResourceDeletion(t *testing.T) {
+	tests := []struct {
+		name string
+		sc   *bootstrap.ServerConfig
+		want bool
+	}{
+		{
+			name: "no server features",
+			sc:   &bootstrap.ServerConfig{},
+			want: false,
+		},
+		{
+			name: "unrelated server feature only",
+			sc:   &bootstrap.ServerConfig{ServerFeatures: []string{"some_other_feature"}},
+			want: false,
+		},
+		{
+			name: "ignore_resource_deletion present",
+			sc:   &bootstrap.ServerConfig{ServerFeatures: []string{"some_other_feature", serverFeatureIgnoreResourceDeletion}},
+			want: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := serverSupportsIgnoreResourceDeletion(test.sc); got != test.want {
+				t.Fatalf("serverSupportsIgnoreResourceDeletion() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// TestOnListenerResourceNotFound_IgnoreResourceDeletionStopsFallbackTimer
+// verifies that when the server currently in use advertises
+// ignore_resource_deletion, a Listener resource-not-found notification keeps
+// serving the last-known-good config and cancels any in-flight fallback
+// timer, since the server that asked us to ignore the deletion is, by
+// definition, still alive and reachable.
+func TestOnListenerResourceNotFound_IgnoreResourceDeletionStopsFallbackTimer(t *testing.T) {
+	servers := []*bootstrap.ServerConfig{{ServerURI: "primary"}, {ServerURI: "secondary"}}
+	r := newTestResolverForFallback(t, servers)
+	defer r.Close()
+
+	r.ignoreResourceDeletion = true
+	r.startFallbackTimer()
+	if r.fallbackTimer == nil {
+		t.Fatalf("fallbackTimer = nil, want armed before onListenerResourceNotFound")
+	}
+
+	// Populate the last-known-good state that a real Listener deletion
+	// would otherwise tear down, so we can verify it survives untouched.
+	wantCS := &configSelector{}
+	wantVH := &xdsresource.VirtualHost{}
+	r.curConfigSelector = wantCS
+	r.currentVirtualHost = wantVH
+	r.currentListener.RouteConfigName = "sentinel-route-config"
+	r.listenerUpdateRecvd = true
+	r.rdsResourceName = "sentinel-rds-name"
+	r.routeConfigUpdateRecvd = true
+
+	r.onListenerResourceNotFound()
+
+	if r.fallbackTimer != nil {
+		t.Fatalf("fallbackTimer = %v, want nil: ignoring a deletion from a reachable server should not trigger fallback", r.fallbackTimer)
+	}
+	if r.numResourcesServedStale != 1 {
+		t.Fatalf("numResourcesServedStale = %d, want 1", r.numResourcesServedStale)
+	}
+
+	// The whole point of ignoreResourceDeletion is that RPCs keep flowing
+	// on the last-known-good config selector; none of the state backing it
+	// should have been reset by the deletion notification.
+	if r.curConfigSelector != wantCS {
+		t.Fatalf("curConfigSelector = %v, want untouched %v", r.curConfigSelector, wantCS)
+	}
+	if r.currentVirtualHost != wantVH {
+		t.Fatalf("currentVirtualHost = %v, want untouched %v", r.currentVirtualHost, wantVH)
+	}
+	if r.currentListener.RouteConfigName != "sentinel-route-config" {
+		t.Fatalf("currentListener.RouteConfigName = %q, want untouched %q", r.currentListener.RouteConfigName, "sentinel-route-config")
+	}
+	if !r.listenerUpdateRecvd {
+		t.Fatalf("listenerUpdateRecvd = false, want unchanged true")
+	}
+	if r.rdsResourceName != "sentinel-rds-name" {
+		t.Fatalf("rdsResourceName = %q, want untouched %q", r.rdsResourceName, "sentinel-rds-name")
+	}
+	if !r.routeConfigUpdateRecvd {
+		t.Fatalf("routeConfigUpdateRecvd = false, want unchanged true")
+	}
+}
+
+// TestOnRouteConfigResourceNotFound_IgnoreResourceDeletionStopsFallbackTimer
+// mirrors TestOnListenerResourceNotFound_IgnoreResourceDeletionStopsFallbackTimer
+// for the RouteConfiguration resource-not-found path.
+func TestOnRouteConfigResourceNotFound_IgnoreResourceDeletionStopsFallbackTimer(t *testing.T) {
+	servers := []*bootstrap.ServerConfig{{ServerURI: "primary"}, {ServerURI: "secondary"}}
+	r := newTestResolverForFallback(t, servers)
+	defer r.Close()
+
+	r.rdsResourceName = "some-route-config"
+	r.ignoreResourceDeletion = true
+	r.startFallbackTimer()
+	if r.fallbackTimer == nil {
+		t.Fatalf("fallbackTimer = nil, want armed before onRouteConfigResourceNotFound")
+	}
+
+	// Populate the last-known-good state that a real RouteConfiguration
+	// deletion would otherwise tear down, so we can verify it survives.
+	wantCS := &configSelector{}
+	wantVH := &xdsresource.VirtualHost{}
+	r.curConfigSelector = wantCS
+	r.currentVirtualHost = wantVH
+	r.routeConfigUpdateRecvd = true
+
+	r.onRouteConfigResourceNotFound(r.rdsResourceName)
+
+	if r.fallbackTimer != nil {
+		t.Fatalf("fallbackTimer = %v, want nil: ignoring a deletion from a reachable server should not trigger fallback", r.fallbackTimer)
+	}
+	if r.numResourcesServedStale != 1 {
+		t.Fatalf("numResourcesServedStale = %d, want 1", r.numResourcesServedStale)
+	}
+	if r.curConfigSelector != wantCS {
+		t.Fatalf("curConfigSelector = %v, want untouched %v", r.curConfigSelector, wantCS)
+	}
+	if r.currentVirtualHost != wantVH {
+		t.Fatalf("currentVirtualHost = %v, want untouched %v", r.currentVirtualHost, wantVH)
+	}
+	if !r.routeConfigUpdateRecvd {
+		t.Fatalf("routeConfigUpdateRecvd = false, want unchanged true")
+	}
+}
+
+// TestOnRouteConfigResourceNotFound_StaleWatcherIgnored verifies that a
+// resource-not-found notification for a route config name that is no longer
+// being watched is dropped before the ignoreResourceDeletion check is even
+// consulted.
+func TestOnRouteConfigResourceNotFound_StaleWatcherIgnored(t *testing.T) {
+	servers := []*bootstrap.ServerConfig{{ServerURI: "primary"}}
+	r := newTestResolverForFallback(t, servers)
+	defer r.Close()
+
+	r.rdsResourceName = "current-route-config"
+	r.ignoreResourceDeletion = true
+
+	r.onRouteConfigResourceNotFound("stale-route-config")
+
+	if r.numResourcesServedStale != 0 {
+		t.Fatalf("numResourcesServedStale = %d, want 0 for a stale watcher notification", r.numResourcesServedStale)
+	}
+}
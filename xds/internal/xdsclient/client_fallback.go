@@ -0,0 +1,36 @@
+/*
+ * Copyright 2024 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package xdsclient
+
+import "google.golang.org/grpc/xds/internal/xdsclient/bootstrap"
+
+// NewWithServerConfig returns an xDS client that only ever talks to the
+// single management server described by sc, instead of the full set of
+// servers in the process-wide bootstrap configuration returned by New.
+//
+// It is used by the xDS resolver to create independent clients for the
+// fallback servers in a target's gRFC A71/A74 xds_servers fallback chain,
+// so that falling back to (or recovering from) one of those servers does
+// not depend on, or interfere with, the client used for steady-state
+// operation against the primary server.
+//
+// The returned close function releases the client's resources and must be
+// called once the client is no longer needed.
+func NewWithServerConfig(sc *bootstrap.ServerConfig) (XDSClient, func(), error) {
+	return newClient(&bootstrap.Config{XDSServers: []*bootstrap.ServerConfig{sc}})
+}